@@ -2,13 +2,20 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
@@ -17,14 +24,33 @@ import (
 
 var imageDir string
 var colorDepth, dim, distance, depth int
+var metric string
+var placement string
+var format, compression string
+var interlace bool
+var animate bool
+var animDelay, animMaxFrames, animLoop int
+var seedFlag int64
+var cacheEntries int
 var procs int = runtime.GOMAXPROCS(runtime.NumCPU())
 
 func init() {
 	wd, e := os.Getwd()
 	check(e)
 	flag.StringVar(&imageDir, "f", wd, "The directory where the image output will be stored.")
-	flag.IntVar(&distance, "d", 125, "The color distance threshold to be used. Larger values execute quickly, but with noisier results.")
+	flag.IntVar(&distance, "d", 125, "The color distance threshold to be used. Larger values execute quickly, but with noisier results. The default (125) is tuned for -metric rgb (0-441 range); lab and ciede2000 operate on a much smaller scale (roughly 0-100) and get their own metric-appropriate default unless -d is set explicitly.")
 	flag.IntVar(&depth, "c", 6, "The color bit depth per channel to be used.")
+	flag.StringVar(&metric, "metric", "rgb", "The color distance metric to use: rgb, lab, ciede2000. Used for distance-sort bucketing and for -placement grow's kd-tree coordinates; that kd-tree isn't a true CIEDE2000 metric space, so ciede2000 falls back to its lab (CIE76) approximation there.")
+	flag.StringVar(&placement, "placement", "linear", "The pixel placement strategy to use: linear, hilbert, grow.")
+	flag.StringVar(&format, "format", "png", "The output image format to use: png, png8, gif, jpeg.")
+	flag.StringVar(&compression, "compression", "default", "PNG compression level to use: default, none, speed, best.")
+	flag.BoolVar(&interlace, "interlace", false, "Request interlaced (Adam7) PNGs. The encoder cannot write them, so this only prints a warning and the output stays non-interlaced.")
+	flag.Int64Var(&seedFlag, "seed", 0, "RNG seed for shuffled/random modes and cache keys. 0 picks one from the current time and prints it for reproducibility.")
+	flag.IntVar(&cacheEntries, "cache-entries", 20, "Maximum number of cached color sequences to keep on disk; oldest are evicted first.")
+	flag.BoolVar(&animate, "animate", false, "In distance-sorted mode, write an animated GIF of colors being placed bucket by bucket instead of a single PNG.")
+	flag.IntVar(&animDelay, "delay", 4, "Animated GIF frame delay, in 100ths of a second.")
+	flag.IntVar(&animMaxFrames, "frames", 200, "Maximum number of frames in the animated GIF; buckets are subsampled evenly if there are more than this.")
+	flag.IntVar(&animLoop, "loop", 0, "Animated GIF loop count. 0 means loop forever.")
 }
 
 // An RGBA color type with atomic operation support.
@@ -32,6 +58,9 @@ type ColorAtomic struct {
 	R, G, B, A uint8
 	Checked bool
 	mutex sync.Mutex
+
+	labOnce sync.Once
+	lab     [3]float64
 }
 
 func (ca ColorAtomic) RGBA() (r, g, b, a uint32) {
@@ -70,6 +99,65 @@ func check(e error) {
     }
 }
 
+// pngCompressionLevel maps the -compression flag to a png.CompressionLevel.
+func pngCompressionLevel() png.CompressionLevel {
+	switch compression {
+	case "none":
+		return png.NoCompression
+	case "speed":
+		return png.BestSpeed
+	case "best":
+		return png.BestCompression
+	default:
+		return png.DefaultCompression
+	}
+}
+
+// formatExt returns the file extension to use for the current -format.
+func formatExt() string {
+	switch format {
+	case "gif":
+		return "gif"
+	case "jpeg":
+		return "jpg"
+	default:
+		return "png"
+	}
+}
+
+// toPaletted converts m into an *image.Paletted whose Palette holds exactly
+// the distinct colors found in m, in order of first appearance. This lets
+// png.Encode pick the smallest bit depth (1/2/4/8) that fits, the same way
+// it would for any hand-built low-color-count image.
+func toPaletted(m image.Image) *image.Paletted {
+	b := m.Bounds()
+	p := image.NewPaletted(b, nil)
+	pal := make(color.Palette, 0, 256)
+	index := make(map[color.RGBA]uint8, 256)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := m.At(x, y).RGBA()
+			c := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(bl >> 8), A: uint8(a >> 8)}
+			idx, ok := index[c]
+			if !ok {
+				if len(pal) >= 256 {
+					panic(fmt.Sprintf("-format %s requires the image to have at most 256 distinct colors; try a smaller -c", format))
+				}
+				idx = uint8(len(pal))
+				pal = append(pal, c)
+				index[c] = idx
+			}
+			p.SetColorIndex(x, y, idx)
+		}
+	}
+	p.Palette = pal
+	return p
+}
+
+// WriteImageFile encodes m to fileName in the format selected by -format,
+// honoring -compression for PNG output. -interlace is not honored: it only
+// prints a warning, and PNGs are always written non-interlaced.
 func WriteImageFile(fileName string, m image.Image) {
 	fmt.Printf("Trying to open file %s...", fileName)
 
@@ -83,21 +171,455 @@ func WriteImageFile(fileName string, m image.Image) {
 
 	w := bufio.NewWriter(f)
 
-	png.Encode(w, m)
+	if interlace {
+		// The standard library's png encoder can only write the default
+		// (non-interlaced) scan order; there's no public knob for Adam7.
+		fmt.Println("warning: -interlace is not supported by encoding/png, writing non-interlaced")
+	}
+
+	switch format {
+	case "png":
+		enc := png.Encoder{CompressionLevel: pngCompressionLevel()}
+		check(enc.Encode(w, m))
+	case "png8":
+		enc := png.Encoder{CompressionLevel: pngCompressionLevel()}
+		check(enc.Encode(w, toPaletted(m)))
+	case "gif":
+		// Reuse toPaletted's exact palette rather than letting gif.Encode fall
+		// back to palette.Plan9 + dithering for non-paletted input.
+		check(gif.Encode(w, toPaletted(m), nil))
+	case "jpeg":
+		check(jpeg.Encode(w, m, nil))
+	default:
+		panic(fmt.Sprintf("unknown -format %q (want png, png8, gif, or jpeg)", format))
+	}
+
 	w.Flush()
 }
 
-func PopImage(colors ColorArray) image.Image {
+// buildFramePalette builds an exact palette (no dithering, no generic
+// system palette) covering every distinct color that will ever appear on
+// the animation's canvas, reserving one slot to mark not-yet-filled
+// pixels. Mirrors toPaletted's exact-color approach, but built once up
+// front since the same palette must stay valid across every frame.
+func buildFramePalette(colors ColorArray) (color.Palette, map[color.RGBA]uint8, uint8) {
+	pal := make(color.Palette, 0, 256)
+	index := make(map[color.RGBA]uint8, 256)
+	for _, c := range colors {
+		rgba := color.RGBA{R: c.R, G: c.G, B: c.B, A: 255}
+		if _, ok := index[rgba]; ok {
+			continue
+		}
+		if len(pal) >= 255 {
+			panic("-animate requires the image to have at most 255 distinct colors (one slot is reserved for the unfilled marker); try a smaller -c")
+		}
+		index[rgba] = uint8(len(pal))
+		pal = append(pal, rgba)
+	}
+	unfilledIndex := uint8(len(pal))
+	pal = append(pal, color.RGBA{0, 0, 0, 0})
+	return pal, index, unfilledIndex
+}
 
-	m := image.NewRGBA(image.Rect(0, 0, dim, dim))
-	b := m.Bounds()
-	
+// snapshotPaletted renders canvas into a paletted frame, marking every pixel
+// at or past index `filled` (in PopImage's linear p = x + y*w ordering) as
+// unfilled via the GIF transparent-index convention.
+//
+// Note: image/gif's encoder auto-detects a palette entry with alpha == 0
+// (pal's reserved unfilled marker) and marks that index transparent in the
+// frame's Graphic Control Extension, so unfilled pixels get real GIF
+// transparency without any extra work here. Disposal is set to
+// DisposalNone so filled regions persist frame to frame regardless.
+func snapshotPaletted(canvas *image.RGBA, filled int, pal color.Palette, index map[color.RGBA]uint8, unfilledIndex uint8) *image.Paletted {
+	b := canvas.Bounds()
+	w := b.Max.Y - b.Min.Y
+	p := image.NewPaletted(b, pal)
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		for x := b.Min.X; x < b.Max.X; x++ {
-			p := x + y * (b.Max.Y - b.Min.Y)
-			m.Set(x, y, colors[p])
+			idx := (x - b.Min.X) + (y-b.Min.Y)*w
+			if idx < filled {
+				p.SetColorIndex(x, y, index[canvas.RGBAAt(x, y)])
+			} else {
+				p.SetColorIndex(x, y, unfilledIndex)
+			}
 		}
 	}
+	return p
+}
+
+// sampleBoundaries evenly subsamples boundaries down to at most max entries,
+// always keeping the final (complete) boundary.
+func sampleBoundaries(boundaries []int, max int) []int {
+	if max <= 0 || len(boundaries) <= max {
+		return boundaries
+	}
+	sampled := make([]int, 0, max)
+	step := float64(len(boundaries)) / float64(max)
+	for i := 0; i < max; i++ {
+		sampled = append(sampled, boundaries[int(float64(i)*step)])
+	}
+	sampled[len(sampled)-1] = boundaries[len(boundaries)-1]
+	return sampled
+}
+
+// WriteAnimatedGIF renders colors as a sequence of frames, one per sampled
+// bucket boundary, each showing the canvas filled up to that point.
+func WriteAnimatedGIF(fileName string, colors ColorArray, boundaries []int) {
+	canvas := image.NewRGBA(image.Rect(0, 0, dim, dim))
+	anim := &gif.GIF{LoopCount: animLoop}
+	pal, index, unfilledIndex := buildFramePalette(colors)
+
+	filled := 0
+	for _, b := range sampleBoundaries(boundaries, animMaxFrames) {
+		fillCanvasRange(canvas, colors, filled, b)
+		filled = b
+		anim.Image = append(anim.Image, snapshotPaletted(canvas, filled, pal, index, unfilledIndex))
+		anim.Delay = append(anim.Delay, animDelay)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+
+	fmt.Printf("Trying to open file %s...", fileName)
+
+	f, e := os.Create(fileName)
+	defer f.Close()
+	check(e)
+
+	if e == nil {
+		fmt.Println("success!")
+	}
+
+	w := bufio.NewWriter(f)
+	check(gif.EncodeAll(w, anim))
+	w.Flush()
+}
+
+// fillCanvasRange draws colors[from:to] onto canvas at their final pixel
+// positions, using the same linear index-to-pixel mapping PopImage has
+// always used. Indices below from are left untouched, so this can be called
+// repeatedly on the same canvas to fill it in incrementally.
+func fillCanvasRange(canvas *image.RGBA, colors ColorArray, from, to int) {
+	b := canvas.Bounds()
+	w := b.Max.Y - b.Min.Y
+	for p := from; p < to; p++ {
+		x := p % w
+		y := p / w
+		canvas.Set(b.Min.X+x, b.Min.Y+y, colors[p])
+	}
+}
+
+func PopImage(colors ColorArray) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, dim, dim))
+	fillCanvasRange(m, colors, 0, len(colors))
+	return m
+}
+
+// PlaceColors renders colors onto the canvas using the strategy selected by
+// -placement: linear (index order, PopImage's original behavior), hilbert
+// (walk a Hilbert curve so nearby indices in colors land near each other
+// spatially), or grow (the classic allRGB grow-from-seed algorithm).
+func PlaceColors(colors ColorArray) image.Image {
+	switch placement {
+	case "linear":
+		return PopImage(colors)
+	case "hilbert":
+		return PlaceHilbert(colors)
+	case "grow":
+		return PlaceGrow(colors)
+	default:
+		panic(fmt.Sprintf("unknown -placement %q (want linear, hilbert, or grow)", placement))
+	}
+}
+
+// hilbertD2XY converts a Hilbert curve distance d (0 <= d < n*n, n a power
+// of two) to (x, y). Standard Wikipedia "d2xy" algorithm.
+func hilbertD2XY(n, d int) (x, y int) {
+	t := d
+	for s := 1; s < n; s *= 2 {
+		rx := 1 & (t / 2)
+		ry := 1 & (t ^ rx)
+		x, y = hilbertRot(s, x, y, rx, ry)
+		x += s * rx
+		y += s * ry
+		t /= 4
+	}
+	return
+}
+
+// hilbertRot rotates/reflects a quadrant so the curve stays continuous.
+func hilbertRot(n, x, y, rx, ry int) (int, int) {
+	if ry == 0 {
+		if rx == 1 {
+			x = n - 1 - x
+			y = n - 1 - y
+		}
+		x, y = y, x
+	}
+	return x, y
+}
+
+// hilbertOrder returns the dim*dim pixels of a dim x dim grid in Hilbert
+// curve order. dim need not be a power of two: the curve is walked at the
+// next power of two and points that fall outside the grid are skipped.
+func hilbertOrder(dim int) []image.Point {
+	n := 1
+	for n < dim {
+		n *= 2
+	}
+	order := make([]image.Point, 0, dim*dim)
+	for d := 0; d < n*n && len(order) < dim*dim; d++ {
+		x, y := hilbertD2XY(n, d)
+		if x < dim && y < dim {
+			order = append(order, image.Point{X: x, Y: y})
+		}
+	}
+	return order
+}
+
+func PlaceHilbert(colors ColorArray) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, dim, dim))
+	order := hilbertOrder(dim)
+	for i, c := range colors {
+		p := order[i]
+		m.Set(p.X, p.Y, c)
+	}
+	return m
+}
+
+// kdPoint is a point in the grow-mode frontier index: a pixel location keyed
+// by its neighborhood mean color. deleted supports lazy deletion, since the
+// frontier churns on every placement and eagerly rebalancing the tree on
+// every removal would defeat the point of indexing it.
+type kdPoint struct {
+	coord   [3]float64
+	pixel   image.Point
+	deleted bool
+}
+
+type kdNode struct {
+	point       *kdPoint
+	axis        int
+	left, right *kdNode
+}
+
+// kdTree is a 3D kd-tree (over RGB or Lab coordinates, matching -metric)
+// used to answer "which frontier pixel's neighborhood mean is closest to
+// this color" in roughly O(log n) rather than scanning the whole frontier.
+type kdTree struct {
+	root      *kdNode
+	size      int
+	deadCount int
+}
+
+func (t *kdTree) Insert(p *kdPoint) {
+	t.root = kdInsert(t.root, p, 0)
+	t.size++
+	t.maybeRebuild()
+}
+
+func kdInsert(n *kdNode, p *kdPoint, depth int) *kdNode {
+	if n == nil {
+		return &kdNode{point: p, axis: depth % 3}
+	}
+	if p.coord[n.axis] < n.point.coord[n.axis] {
+		n.left = kdInsert(n.left, p, depth+1)
+	} else {
+		n.right = kdInsert(n.right, p, depth+1)
+	}
+	return n
+}
+
+// Delete lazily marks p as removed; it is skipped by Nearest and purged on
+// the next rebuild.
+func (t *kdTree) Delete(p *kdPoint) {
+	p.deleted = true
+	t.size--
+	t.deadCount++
+}
+
+func sqDist3(a, b [3]float64) float64 {
+	dx, dy, dz := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+// Nearest returns the live point closest to target, or nil if the tree is
+// empty.
+func (t *kdTree) Nearest(target [3]float64) *kdPoint {
+	var best *kdPoint
+	bestDist := math.Inf(1)
+
+	var search func(n *kdNode)
+	search = func(n *kdNode) {
+		if n == nil {
+			return
+		}
+		if !n.point.deleted {
+			if d := sqDist3(n.point.coord, target); d < bestDist {
+				bestDist = d
+				best = n.point
+			}
+		}
+		diff := target[n.axis] - n.point.coord[n.axis]
+		near, far := n.left, n.right
+		if diff >= 0 {
+			near, far = n.right, n.left
+		}
+		search(near)
+		if diff*diff < bestDist {
+			search(far)
+		}
+	}
+	search(t.root)
+	return best
+}
+
+// maybeRebuild rebalances the tree from its still-live points once dead
+// entries outnumber live ones, bounding how much lazy deletion can degrade
+// query time.
+func (t *kdTree) maybeRebuild() {
+	if t.deadCount < 64 || t.deadCount <= t.size {
+		return
+	}
+	live := make([]*kdPoint, 0, t.size)
+	var collect func(n *kdNode)
+	collect = func(n *kdNode) {
+		if n == nil {
+			return
+		}
+		if !n.point.deleted {
+			live = append(live, n.point)
+		}
+		collect(n.left)
+		collect(n.right)
+	}
+	collect(t.root)
+	t.root = kdBuildBalanced(live, 0)
+	t.deadCount = 0
+}
+
+func kdBuildBalanced(points []*kdPoint, depth int) *kdNode {
+	if len(points) == 0 {
+		return nil
+	}
+	axis := depth % 3
+	sort.Slice(points, func(i, j int) bool { return points[i].coord[axis] < points[j].coord[axis] })
+	mid := len(points) / 2
+	node := &kdNode{point: points[mid], axis: axis}
+	node.left = kdBuildBalanced(points[:mid], depth+1)
+	node.right = kdBuildBalanced(points[mid+1:], depth+1)
+	return node
+}
+
+// growCoord maps a color into the coordinate space the grow-mode kd-tree is
+// built over. CIEDE2000 isn't a Euclidean metric so it can't back a metric
+// tree directly; for "lab" and "ciede2000" alike we index in Lab (CIE76)
+// space, which is the closest Euclidean approximation.
+func growCoord(r, g, b float64) [3]float64 {
+	if metric == "rgb" {
+		return [3]float64{r, g, b}
+	}
+	tmp := &ColorAtomic{R: uint8(r), G: uint8(g), B: uint8(b)}
+	lab := tmp.LabValue()
+	return lab
+}
+
+func growNeighbors(p image.Point) [8]image.Point {
+	return [8]image.Point{
+		{X: p.X - 1, Y: p.Y - 1}, {X: p.X, Y: p.Y - 1}, {X: p.X + 1, Y: p.Y - 1},
+		{X: p.X - 1, Y: p.Y}, {X: p.X + 1, Y: p.Y},
+		{X: p.X - 1, Y: p.Y + 1}, {X: p.X, Y: p.Y + 1}, {X: p.X + 1, Y: p.Y + 1},
+	}
+}
+
+func growInBounds(p image.Point) bool {
+	return p.X >= 0 && p.X < dim && p.Y >= 0 && p.Y < dim
+}
+
+// growNeighborhoodMean averages the already-filled neighbors of p, which by
+// construction (every frontier pixel is adjacent to at least one filled
+// pixel) is always at least one pixel.
+func growNeighborhoodMean(m *image.RGBA, filled []bool, p image.Point) (float64, float64, float64) {
+	var rs, gs, bs float64
+	var n int
+	for _, nb := range growNeighbors(p) {
+		if growInBounds(nb) && filled[nb.Y*dim+nb.X] {
+			r, g, b, _ := m.At(nb.X, nb.Y).RGBA()
+			rs += float64(r >> 8)
+			gs += float64(g >> 8)
+			bs += float64(b >> 8)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return rs / float64(n), gs / float64(n), bs / float64(n)
+}
+
+// PlaceGrow implements the classic allRGB "grow from seeds" placement:
+// starting from a center seed pixel, it maintains a frontier of empty
+// pixels adjacent to already-filled ones, keyed in a kd-tree by their
+// neighborhood mean color (see growCoord for how -metric maps onto the
+// tree's coordinate space). For each next color in colors (in the order
+// produced by the generator/distance-sort pipeline), it places the color at
+// the frontier pixel whose neighborhood mean is closest, then folds that
+// pixel's empty neighbors into the frontier.
+func PlaceGrow(colors ColorArray) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, dim, dim))
+	if len(colors) == 0 {
+		return m
+	}
+
+	filled := make([]bool, dim*dim)
+	tree := &kdTree{}
+	frontier := make(map[image.Point]*kdPoint)
+
+	addToFrontier := func(p image.Point) {
+		if old, ok := frontier[p]; ok {
+			tree.Delete(old)
+		}
+		r, g, b := growNeighborhoodMean(m, filled, p)
+		kp := &kdPoint{coord: growCoord(r, g, b), pixel: p}
+		frontier[p] = kp
+		tree.Insert(kp)
+	}
+
+	place := func(p image.Point, c *ColorAtomic) {
+		m.Set(p.X, p.Y, c)
+		filled[p.Y*dim+p.X] = true
+		if fp, ok := frontier[p]; ok {
+			tree.Delete(fp)
+			delete(frontier, p)
+		}
+		for _, n := range growNeighbors(p) {
+			if growInBounds(n) && !filled[n.Y*dim+n.X] {
+				addToFrontier(n)
+			}
+		}
+	}
+
+	// fallbackEmptyPixel guards against the frontier and kd-tree ever
+	// disagreeing with the filled bitmap; on a fully connected grid this
+	// should never be needed.
+	fallbackEmptyPixel := func() image.Point {
+		for i, f := range filled {
+			if !f {
+				return image.Point{X: i % dim, Y: i / dim}
+			}
+		}
+		return image.Point{}
+	}
+
+	place(image.Point{X: dim / 2, Y: dim / 2}, colors[0])
+
+	for _, c := range colors[1:] {
+		var next image.Point
+		if best := tree.Nearest(growCoord(float64(c.R), float64(c.G), float64(c.B))); best != nil {
+			next = best.pixel
+		} else {
+			next = fallbackEmptyPixel()
+		}
+		place(next, c)
+	}
 
 	return m
 }
@@ -131,17 +653,26 @@ func GenLinearColors(do_map bool) ColorArray {
 	return colors
 }
 
-func GenShuffledColors(reseed, do_map bool) ColorArray {
-	// Calculate all possible RGB colors via a nested loops, where the possible values have been shuffled
-	if reseed {
-		rand.Seed(time.Now().UnixNano())
-	}
+// rngFor derives a *rand.Rand from -seed and a label identifying the call
+// site (e.g. "shuffled", "random", "distsort"). Each label gets its own
+// independent, reproducible stream instead of drawing from the shared
+// math/rand global source, whose output would otherwise depend on how many
+// prior draws happened earlier in the process (which menu choices came
+// before this one) rather than on -seed alone. That independence is what
+// lets the on-disk cache key on seedFlag alone.
+func rngFor(label string) *rand.Rand {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d|%s", seedFlag, label)))
+	seed := int64(binary.BigEndian.Uint64(h[:8]))
+	return rand.New(rand.NewSource(seed))
+}
 
+func GenShuffledColors(rng *rand.Rand, do_map bool) ColorArray {
+	// Calculate all possible RGB colors via a nested loops, where the possible values have been shuffled
 	colors := make(ColorArray, dim * dim)
 	i := 0
-	for _, r := range rand.Perm(colorDepth) {
-		for _, g := range rand.Perm(colorDepth) {
-			for _, b := range rand.Perm(colorDepth) {
+	for _, r := range rng.Perm(colorDepth) {
+		for _, g := range rng.Perm(colorDepth) {
+			for _, b := range rng.Perm(colorDepth) {
 				c := new(ColorAtomic)
 				c.R, c.G, c.B, c.A = uint8(r), uint8(g), uint8(b), uint8(255)
 				if do_map {
@@ -156,11 +687,11 @@ func GenShuffledColors(reseed, do_map bool) ColorArray {
 	return colors
 }
 
-func GenRandomColors() ColorArray {
-	colors := GenShuffledColors(true, true)
+func GenRandomColors(rng *rand.Rand) ColorArray {
+	colors := GenShuffledColors(rng, true)
 
 	for i := range colors {
-    	j := rand.Intn(i + 1)
+    	j := rng.Intn(i + 1)
     	colors[i], colors[j] = colors[j], colors[i]
 	}
 
@@ -175,7 +706,7 @@ func GenSortColors() ColorArray {
 	return colors
 }
 
-func GenDistSortColors(dist float64, colors ColorArray) chan ColorArray {
+func GenDistSortColors(dist float64, colors ColorArray, distFn DistanceFunc) chan ColorArray {
 
 	out_chan := make(chan ColorArray)
 	go func() {
@@ -193,7 +724,7 @@ func GenDistSortColors(dist float64, colors ColorArray) chan ColorArray {
 				// Traverse colors array looking for colors within the threshold
 				for _, w := range colors {
 
-					if !w.Checked && color_distance(r_color, w) < dist {
+					if !w.Checked && distFn(r_color, w) < dist {
 						w.Checked = true
 						d_colors = append(d_colors, w)
 					}
@@ -214,6 +745,192 @@ func color_distance(i, j *ColorAtomic) float64 {
 	return math.Sqrt(math.Pow(float64(j.R - i.R), 2) + math.Pow(float64(j.G - i.G), 2) + math.Pow(float64(j.B - i.B), 2))
 }
 
+// A pluggable metric between two colors, used by the distance-sort pipeline.
+type DistanceFunc func(a, b *ColorAtomic) float64
+
+// D65 whitepoint, used for the XYZ->Lab scaling (the sRGB->XYZ matrix in
+// linearToXYZ is D65-referenced too, with its coefficients written out).
+var d65White = [3]float64{0.95047, 1.0, 1.08883}
+
+// sRGB->linear RGB, per the standard piecewise gamma curve.
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255.0
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Linear sRGB -> CIE XYZ (D65), via the standard sRGB primaries matrix.
+func linearToXYZ(r, g, b float64) (x, y, z float64) {
+	x = r*0.4124564 + g*0.3575761 + b*0.1804375
+	y = r*0.2126729 + g*0.7151522 + b*0.0721750
+	z = r*0.0193339 + g*0.1191920 + b*0.9503041
+	return
+}
+
+// XYZ -> Lab, using the standard f(t) piecewise cube root.
+func xyzToLab(x, y, z float64) (l, a, b float64) {
+	fx := labF(x / d65White[0])
+	fy := labF(y / d65White[1])
+	fz := labF(z / d65White[2])
+
+	l = 116*fy - 16
+	a = 500 * (fx - fy)
+	b = 200 * (fy - fz)
+	return
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29.0
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29.0
+}
+
+// LabValue returns the CIE Lab coordinates of ca, converting from sRGB and
+// caching the result on the ColorAtomic so repeated distance comparisons
+// only pay for the conversion once.
+func (ca *ColorAtomic) LabValue() [3]float64 {
+	ca.labOnce.Do(func() {
+		r := srgbToLinear(ca.R)
+		g := srgbToLinear(ca.G)
+		b := srgbToLinear(ca.B)
+		x, y, z := linearToXYZ(r, g, b)
+		l, a, bb := xyzToLab(x, y, z)
+		ca.lab = [3]float64{l, a, bb}
+	})
+	return ca.lab
+}
+
+// color_distance_rgb is the plain Euclidean distance in sRGB space.
+func color_distance_rgb(i, j *ColorAtomic) float64 {
+	dr := float64(j.R) - float64(i.R)
+	dg := float64(j.G) - float64(i.G)
+	db := float64(j.B) - float64(i.B)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+// color_distance_lab is CIE76 (Euclidean) distance in Lab space.
+func color_distance_lab(i, j *ColorAtomic) float64 {
+	li := i.LabValue()
+	lj := j.LabValue()
+	return math.Sqrt(math.Pow(lj[0]-li[0], 2) + math.Pow(lj[1]-li[1], 2) + math.Pow(lj[2]-li[2], 2))
+}
+
+// color_distance_ciede2000 implements the full CIEDE2000 color difference
+// formula, which corrects CIE76/CIE94's perceptual non-uniformity in the
+// blue and low-chroma regions via the T, RT, SL, SC and SH weighting terms.
+func color_distance_ciede2000(i, j *ColorAtomic) float64 {
+	li := i.LabValue()
+	lj := j.LabValue()
+
+	l1, a1, b1 := li[0], li[1], li[2]
+	l2, a2, b2 := lj[0], lj[1], lj[2]
+
+	c1 := math.Hypot(a1, b1)
+	c2 := math.Hypot(a2, b2)
+	cBar := (c1 + c2) / 2
+
+	g := 0.5 * (1 - math.Sqrt(math.Pow(cBar, 7)/(math.Pow(cBar, 7)+math.Pow(25, 7))))
+	a1p := (1 + g) * a1
+	a2p := (1 + g) * a2
+
+	c1p := math.Hypot(a1p, b1)
+	c2p := math.Hypot(a2p, b2)
+
+	h1p := atan2Deg(b1, a1p)
+	h2p := atan2Deg(b2, a2p)
+
+	deltaLp := l2 - l1
+	deltaCp := c2p - c1p
+
+	var deltahp float64
+	switch {
+	case c1p*c2p == 0:
+		deltahp = 0
+	case math.Abs(h2p-h1p) <= 180:
+		deltahp = h2p - h1p
+	case h2p-h1p > 180:
+		deltahp = h2p - h1p - 360
+	default:
+		deltahp = h2p - h1p + 360
+	}
+	deltaHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(deg2rad(deltahp)/2)
+
+	lBarp := (l1 + l2) / 2
+	cBarp := (c1p + c2p) / 2
+
+	var hBarp float64
+	switch {
+	case c1p*c2p == 0:
+		hBarp = h1p + h2p
+	case math.Abs(h1p-h2p) <= 180:
+		hBarp = (h1p + h2p) / 2
+	case h1p+h2p < 360:
+		hBarp = (h1p+h2p+360)/2
+	default:
+		hBarp = (h1p + h2p - 360) / 2
+	}
+
+	t := 1 - 0.17*math.Cos(deg2rad(hBarp-30)) +
+		0.24*math.Cos(deg2rad(2*hBarp)) +
+		0.32*math.Cos(deg2rad(3*hBarp+6)) -
+		0.20*math.Cos(deg2rad(4*hBarp-63))
+
+	deltaTheta := 30 * math.Exp(-math.Pow((hBarp-275)/25, 2))
+	rc := 2 * math.Sqrt(math.Pow(cBarp, 7)/(math.Pow(cBarp, 7)+math.Pow(25, 7)))
+	rt := -rc * math.Sin(deg2rad(2*deltaTheta))
+
+	sl := 1 + (0.015*math.Pow(lBarp-50, 2))/math.Sqrt(20+math.Pow(lBarp-50, 2))
+	sc := 1 + 0.045*cBarp
+	sh := 1 + 0.015*cBarp*t
+
+	const kl, kc, kh = 1.0, 1.0, 1.0
+
+	return math.Sqrt(
+		math.Pow(deltaLp/(kl*sl), 2) +
+			math.Pow(deltaCp/(kc*sc), 2) +
+			math.Pow(deltaHp/(kh*sh), 2) +
+			rt*(deltaCp/(kc*sc))*(deltaHp/(kh*sh)),
+	)
+}
+
+func deg2rad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func rad2deg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// atan2Deg is atan2 normalized to [0, 360) degrees, as CIEDE2000 expects h'.
+func atan2Deg(y, x float64) float64 {
+	if x == 0 && y == 0 {
+		return 0
+	}
+	d := rad2deg(math.Atan2(y, x))
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// distanceFuncFromName resolves a -metric flag value to a DistanceFunc.
+func distanceFuncFromName(name string) DistanceFunc {
+	switch name {
+	case "rgb":
+		return color_distance_rgb
+	case "lab":
+		return color_distance_lab
+	case "ciede2000":
+		return color_distance_ciede2000
+	default:
+		panic(fmt.Sprintf("unknown -metric %q (want rgb, lab, or ciede2000)", name))
+	}
+}
+
 // Stolen directly from http://blog.golang.org/pipelines
 func merge(cs ...chan ColorArray) chan ColorArray {
     var wg sync.WaitGroup
@@ -257,10 +974,206 @@ func printStat() {
 	fmt.Printf("Writing image to %s\n", imageDir)
 }
 
+// Generator produces a complete ColorArray for the current colorDepth/dim,
+// and reports a key identifying everything about the run that affects its
+// output, so equivalent runs can share a cache entry.
+type Generator interface {
+	CacheKey() string
+	Generate() ColorArray
+}
+
+type linearGenerator struct{}
+
+func (linearGenerator) CacheKey() string     { return "linear" }
+func (linearGenerator) Generate() ColorArray { return GenLinearColors(true) }
+
+type shuffledGenerator struct{}
+
+func (shuffledGenerator) CacheKey() string     { return fmt.Sprintf("shuffled:%d", seedFlag) }
+func (shuffledGenerator) Generate() ColorArray { return GenShuffledColors(rngFor("shuffled"), true) }
+
+type randomGenerator struct{}
+
+func (randomGenerator) CacheKey() string     { return fmt.Sprintf("random:%d", seedFlag) }
+func (randomGenerator) Generate() ColorArray { return GenRandomColors(rngFor("random")) }
+
+type sortedGenerator struct{}
+
+func (sortedGenerator) CacheKey() string     { return "sorted" }
+func (sortedGenerator) Generate() ColorArray { return GenSortColors() }
+
+type distSortGenerator struct {
+	dist float64
+}
+
+func (g distSortGenerator) CacheKey() string {
+	return fmt.Sprintf("distsort:%d:%d:%s", seedFlag, int(g.dist), metric)
+}
+
+func (g distSortGenerator) Generate() ColorArray {
+	return runDistSort(g.dist, distanceFuncFromName(metric), nil)
+}
+
+// runDistSort drives the distance-sort bucket pipeline (shared by
+// distSortGenerator and the -animate path, which additionally needs to
+// observe each bucket as it lands via onBucket).
+func runDistSort(dist float64, distFn DistanceFunc, onBucket func(total int)) ColorArray {
+	inColors := GenRandomColors(rngFor("distsort"))
+
+	chans := make([]chan ColorArray, procs*2)
+	for i := 0; i < len(chans); i++ {
+		chans[i] = GenDistSortColors(dist, inColors, distFn)
+	}
+
+	colors := make(ColorArray, 0, dim*dim)
+	for n := range merge(chans...) {
+		colors = append(colors, n...)
+		if onBucket != nil {
+			onBucket(len(colors))
+		}
+		fmt.Printf("Processed colors: %d of %d (%3.2f%%)\r", len(colors), (dim * dim), (float64(len(colors)) / math.Pow(float64(dim), 2) * 100.0))
+	}
+	fmt.Println("")
+
+	// This is somewhat naïve error checking, since it just prints a warning. It's good enough for this purpose, though.
+	if len(colors) != int(math.Pow(float64(colorDepth), 3)) {
+		fmt.Printf("ERROR ERROR ERROR --> %d != %d\n", len(colors), int(math.Pow(float64(colorDepth), 3)))
+	}
+
+	return colors
+}
+
+// cacheDir returns (creating if necessary) the directory holding cached
+// ColorArray blobs, alongside the rendered images.
+func cacheDir() string {
+	dir := filepath.Join(imageDir, ".gocache")
+	check(os.MkdirAll(dir, 0755))
+	return dir
+}
+
+// cachePath hashes (g.CacheKey(), colorDepth) into a stable on-disk path, so
+// identical (mode, colorDepth, seed, distance, metric) combinations always
+// hit the same entry.
+func cachePath(g Generator) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", g.CacheKey(), colorDepth)))
+	return filepath.Join(cacheDir(), hex.EncodeToString(h[:])+".bin")
+}
+
+// loadCached reads a previously cached ColorArray for g, if present. Cache
+// entries are a compact colorDepth^3*3 byte blob (one RGB triple per
+// generated color, in order; this is dim*dim*3 when -c is even), since alpha
+// is always opaque for generated colors.
+func loadCached(g Generator) (ColorArray, bool) {
+	n := colorDepth * colorDepth * colorDepth
+	data, e := os.ReadFile(cachePath(g))
+	if e != nil || len(data) != n*3 {
+		return nil, false
+	}
+
+	colors := make(ColorArray, n)
+	for i := range colors {
+		colors[i] = &ColorAtomic{R: data[i*3], G: data[i*3+1], B: data[i*3+2], A: 255}
+	}
+	return colors, true
+}
+
+func storeCached(g Generator, colors ColorArray) {
+	data := make([]byte, 0, len(colors)*3)
+	for _, c := range colors {
+		data = append(data, c.R, c.G, c.B)
+	}
+	check(os.WriteFile(cachePath(g), data, 0644))
+}
+
+// evictCacheLRU trims the cache directory down to -cache-entries, removing
+// the least recently touched entries first.
+func evictCacheLRU() {
+	entries, e := os.ReadDir(cacheDir())
+	if e != nil || len(entries) <= cacheEntries {
+		return
+	}
+
+	type cacheFile struct {
+		name    string
+		modTime time.Time
+	}
+	files := make([]cacheFile, 0, len(entries))
+	for _, ent := range entries {
+		info, e := ent.Info()
+		if e != nil {
+			continue
+		}
+		files = append(files, cacheFile{ent.Name(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for _, f := range files[:len(files)-cacheEntries] {
+		os.Remove(filepath.Join(cacheDir(), f.name))
+	}
+}
+
+// Generate runs g, transparently caching its result on disk so repeated
+// runs with the same (mode, colorDepth, seed, distance, metric) are instant
+// after the first.
+func Generate(g Generator) ColorArray {
+	if colors, ok := loadCached(g); ok {
+		now := time.Now()
+		os.Chtimes(cachePath(g), now, now)
+		return colors
+	}
+
+	colors := g.Generate()
+	storeCached(g, colors)
+	evictCacheLRU()
+	return colors
+}
+
+// defaultDistanceForMetric returns the -d default appropriate for m. RGB
+// distance ranges over roughly 0-441 (sqrt(255^2*3)), while Lab-based
+// metrics range over roughly 0-100; CIEDE2000 further compresses most
+// differences relative to raw Lab (CIE76). These defaults are picked to
+// land in the same rough ballpark of bucket granularity as the rgb default.
+func defaultDistanceForMetric(m string) int {
+	switch m {
+	case "lab":
+		return 25
+	case "ciede2000":
+		return 10
+	default:
+		return 125
+	}
+}
+
 func main() {
 
 	flag.Parse()
 
+	distanceSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "d" {
+			distanceSet = true
+		}
+	})
+	if !distanceSet {
+		distance = defaultDistanceForMetric(metric)
+	}
+
+	if animate && placement != "linear" {
+		// WriteAnimatedGIF drives fillCanvasRange, which only knows the
+		// original linear p = x + y*w fill order; it has no way to snapshot
+		// hilbert/grow mid-placement, so rather than silently rendering the
+		// wrong animation we say so and fall back to linear for the animation.
+		// Menu choices other than 5 still render with -placement.
+		fmt.Printf("warning: -animate only supports -placement linear; ignoring -placement %s for the animated distance-sorted output\n", placement)
+	}
+
+	if seedFlag == 0 {
+		seedFlag = time.Now().UnixNano()
+		fmt.Printf("Using random seed %d (pass -seed %d to reproduce this run)\n", seedFlag, seedFlag)
+	}
+	// Each generator derives its own *rand.Rand from seedFlag via rngFor, so
+	// there's no shared math/rand global source left to seed here.
+
 	colorDepth = int(math.Pow(2, float64(depth)))
 
 	// Cube our color depth, then take the square root to calculate the image dimensions
@@ -269,6 +1182,7 @@ func main() {
 	done := false
 	var choice, funcName string
 	var colors ColorArray
+	var boundaries []int
 
 	printStat()	
 
@@ -279,42 +1193,34 @@ func main() {
 			case "1":
 				fmt.Printf("Generating %dx%d linear image...\n", dim, dim)
 				funcName = "linear"
-				colors = GenLinearColors(true)
+				colors = Generate(linearGenerator{})
 			case "2":
 				fmt.Printf("Generating %dx%d shuffled image...\n", dim, dim)
 				funcName = "shuffled"
-				colors = GenShuffledColors(true, true)
+				colors = Generate(shuffledGenerator{})
 			case "3":
 				fmt.Printf("Generating %dx%d randomized image...\n", dim, dim)
 				funcName = "random"
-				colors = GenRandomColors()
+				colors = Generate(randomGenerator{})
 			case "4":
 				fmt.Printf("Generating %dx%d sorted image (stable sort, additive method)...\n", dim, dim)
 				funcName = "sorted"
-				colors = GenSortColors()
+				colors = Generate(sortedGenerator{})
 			case "5":
 				fmt.Printf("Generating %dx%d distance sorted image (this may take a while)...\n", dim, dim)
 				d := float64(distance)
-				funcName = fmt.Sprintf("distance_%d", int(d))
-				inColors := GenRandomColors()
-
-				chans := make([]chan ColorArray, procs*2)
-				for i := 0; i < len(chans); i++ {
-					chans[i] = GenDistSortColors(d, inColors)
-				}
+				funcName = fmt.Sprintf("distance_%d_%s", int(d), metric)
+				boundaries = nil
 
-				colors = make(ColorArray, dim * dim)
-				colors = nil  // I have no idea why this is necessary
-
-			    for n := range merge(chans...) {
-					colors = append(colors, n...)
-					fmt.Printf("Processed colors: %d of %d (%3.2f%%)\r", len(colors), (dim * dim), (float64(len(colors)) / math.Pow(float64(dim), 2) * 100.0))
-				}
-				fmt.Println("")
-
-				// This is somewhat naïve error checking, since it just prints a warning. It's good enough for this purpose, though.
-				if len(colors) != int(math.Pow(float64(colorDepth), 3)) {
-					fmt.Printf("ERROR ERROR ERROR --> %d != %d\n", len(colors), int(math.Pow(float64(colorDepth), 3)))
+				if animate {
+					// -animate needs to observe every bucket as it's produced, so it
+					// bypasses the cache and always runs the pipeline live.
+					distFn := distanceFuncFromName(metric)
+					colors = runDistSort(d, distFn, func(total int) {
+						boundaries = append(boundaries, total)
+					})
+				} else {
+					colors = Generate(distSortGenerator{dist: d})
 				}
 			case "q":
 				done = true
@@ -324,8 +1230,13 @@ func main() {
 				fmt.Printf("'%s' is not a valid choice, please try again.\n", choice)
 		}
 		if funcName != "" && colors != nil {
-			fileName := fmt.Sprintf("%s/%s_%d.png", imageDir, funcName, colorDepth)
-			WriteImageFile(fileName, PopImage(colors))
+			if choice == "5" && animate {
+				fileName := fmt.Sprintf("%s/%s_%d.gif", imageDir, funcName, colorDepth)
+				WriteAnimatedGIF(fileName, colors, boundaries)
+			} else {
+				fileName := fmt.Sprintf("%s/%s_%s_%d.%s", imageDir, funcName, placement, colorDepth, formatExt())
+				WriteImageFile(fileName, PlaceColors(colors))
+			}
 		}
 	}
 }